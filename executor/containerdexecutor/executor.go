@@ -2,6 +2,7 @@ package containerdexecutor
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
 	containerdoci "github.com/containerd/containerd/oci"
 	"github.com/containerd/continuity/fs"
 	"github.com/docker/docker/pkg/idtools"
@@ -34,10 +37,17 @@ type containerdExecutor struct {
 	dnsConfig        *oci.DNSConfig
 	running          map[string]chan error
 	mu               *sync.Mutex
+	idmap            *idtools.IdentityMapping
+	rootless         bool
+	// checkpointed tracks ids whose task is exiting because Checkpoint asked
+	// it to (via containerd.WithCheckpointTaskExit), so Run's cleanup can
+	// tell that exit apart from a real container stop and leave the
+	// container/task in place for a later Restore.
+	checkpointed map[string]struct{}
 }
 
 // New creates a new executor backed by connection to containerd API
-func New(client *containerd.Client, root, cgroup string, networkProviders map[pb.NetMode]network.Provider, dnsConfig *oci.DNSConfig) executor.Executor {
+func New(client *containerd.Client, root, cgroup string, networkProviders map[pb.NetMode]network.Provider, dnsConfig *oci.DNSConfig, idmap *idtools.IdentityMapping, rootless bool) executor.Executor {
 	// clean up old hosts/resolv.conf file. ignore errors
 	os.RemoveAll(filepath.Join(root, "hosts"))
 	os.RemoveAll(filepath.Join(root, "resolv.conf"))
@@ -50,9 +60,47 @@ func New(client *containerd.Client, root, cgroup string, networkProviders map[pb
 		dnsConfig:        dnsConfig,
 		running:          make(map[string]chan error),
 		mu:               &sync.Mutex{},
+		idmap:            idmap,
+		rootless:         rootless,
+		checkpointed:     make(map[string]struct{}),
 	}
 }
 
+// mergeDNSConfig overlays a per-build DNS override on top of the daemon-level
+// DNS config, letting an individual build supply its own nameservers, search
+// domains, or options (e.g. ndots:0) without changing the defaults used by
+// other builds sharing the same executor.
+func mergeDNSConfig(base *oci.DNSConfig, override *executor.DNS) *oci.DNSConfig {
+	merged := oci.DNSConfig{}
+	if base != nil {
+		merged = *base
+	}
+	if len(override.Nameservers) > 0 {
+		merged.Nameservers = override.Nameservers
+	}
+	if len(override.SearchDomains) > 0 {
+		merged.SearchDomains = override.SearchDomains
+	}
+	if len(override.Options) > 0 {
+		merged.Options = override.Options
+	}
+	return &merged
+}
+
+// toSpecIDMap converts docker's idtools.IDMap entries into the OCI runtime
+// spec's LinuxIDMapping form used by containerdoci.WithUserNamespace.
+func toSpecIDMap(m []idtools.IDMap) []specs.LinuxIDMapping {
+	var specMap []specs.LinuxIDMapping
+	for _, entry := range m {
+		specMap = append(specMap, specs.LinuxIDMapping{
+			ContainerID: uint32(entry.ContainerID),
+			HostID:      uint32(entry.HostID),
+			Size:        uint32(entry.Size),
+		})
+	}
+	return specMap
+}
+
 func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mountable, mounts []executor.Mount, process executor.ProcessInfo, started chan<- struct{}) (err error) {
 	if id == "" {
 		id = identity.NewID()
@@ -77,10 +125,20 @@ func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mount
 
 	meta := process.Meta
 
-	resolvConf, err := oci.GetResolvConf(ctx, w.root, nil, w.dnsConfig)
+	// Generate resolv.conf per container id rather than sharing a single file
+	// under w.root, so concurrent builds don't race on each other's DNS
+	// settings. A per-build DNS override on meta takes precedence over the
+	// daemon-level config.
+	dnsConfig := w.dnsConfig
+	if meta.DNS != nil {
+		dnsConfig = mergeDNSConfig(w.dnsConfig, meta.DNS)
+	}
+	netRoot := filepath.Join(w.root, "net", id)
+	resolvConf, err := oci.GetResolvConf(ctx, netRoot, nil, dnsConfig)
 	if err != nil {
 		return sendErr(done, err)
 	}
+	defer os.RemoveAll(netRoot)
 
 	hostsFile, clean, err := oci.GetHostsFile(ctx, w.root, meta.ExtraHosts, nil)
 	if err != nil {
@@ -121,6 +179,13 @@ func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mount
 			UID: int(uid),
 			GID: int(gid),
 		}
+		if w.idmap != nil {
+			identity, err = w.idmap.ToHost(identity)
+			if err != nil {
+				lm.Unmount()
+				return sendErr(done, errors.Wrapf(err, "failed to map uid %d gid %d to host", uid, gid))
+			}
+		}
 
 		newp, err := fs.RootPath(rootfsPath, meta.Cwd)
 		if err != nil {
@@ -155,6 +220,9 @@ func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mount
 	if meta.ReadonlyRootFS {
 		opts = append(opts, containerdoci.WithRootFSReadonly())
 	}
+	if w.idmap != nil && len(w.idmap.UIDMaps) > 0 && len(w.idmap.GIDMaps) > 0 {
+		opts = append(opts, containerdoci.WithUserNamespace(toSpecIDMap(w.idmap.UIDMaps), toSpecIDMap(w.idmap.GIDMaps)))
+	}
 
 	if w.cgroupParent != "" {
 		var cgroupsPath string
@@ -165,6 +233,15 @@ func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mount
 			cgroupsPath = filepath.Join("/", w.cgroupParent, "buildkit", id)
 		}
 		opts = append(opts, containerdoci.WithCgroup(cgroupsPath))
+	} else if w.rootless {
+		// Unprivileged buildkitd can't reach the root cgroup hierarchy; scope
+		// each build under the real uid's delegated user.slice on the
+		// cgroup v2 unified hierarchy instead. w.idmap only remaps the build
+		// container's own uid/gid into a user namespace and has no relation
+		// to the host uid systemd delegated this slice to, so it must not be
+		// used here — always use the process's real uid.
+		cgroupsPath := filepath.Join("/user.slice", fmt.Sprintf("user-%d.slice", os.Getuid()), "buildkit", id)
+		opts = append(opts, containerdoci.WithCgroup(cgroupsPath))
 	}
 	processMode := oci.ProcessSandbox // FIXME(AkihiroSuda)
 	spec, cleanup, err := oci.GenerateSpec(ctx, meta, mounts, id, resolvConf, hostsFile, namespace, processMode, nil, opts...)
@@ -181,6 +258,15 @@ func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mount
 	}
 
 	defer func() {
+		w.mu.Lock()
+		_, checkpointed := w.checkpointed[id]
+		delete(w.checkpointed, id)
+		w.mu.Unlock()
+		if checkpointed {
+			// Checkpoint asked this task to exit; leave the container in
+			// place so Restore can later start a new task on it.
+			return
+		}
 		if err1 := container.Delete(context.TODO()); err == nil && err1 != nil {
 			err = errors.Wrapf(err1, "failed to delete container %s", id)
 			sendErr(done, err)
@@ -197,6 +283,14 @@ func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mount
 		return sendErr(done, err)
 	}
 	defer func() {
+		w.mu.Lock()
+		_, checkpointed := w.checkpointed[id]
+		w.mu.Unlock()
+		if checkpointed {
+			// Leave the task record for Restore; the outer container-delete
+			// defer clears the checkpointed marker once both defers have run.
+			return
+		}
 		if _, err1 := task.Delete(context.TODO()); err == nil && err1 != nil {
 			err = errors.Wrapf(err1, "failed to delete task %s", id)
 			sendErr(done, err)
@@ -249,6 +343,100 @@ func (w containerdExecutor) Run(ctx context.Context, id string, root cache.Mount
 	}
 }
 
+// getTask looks up the running containerd task for id, returning an error if
+// the container or its task cannot be found.
+func (w containerdExecutor) getTask(ctx context.Context, id string) (containerd.Task, error) {
+	container, err := w.client.LoadContainer(ctx, id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "container %s not found", id)
+	}
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "no running task for container %s", id)
+	}
+	return task, nil
+}
+
+// Pause suspends the container's task, freezing its process group in place via
+// containerd's cgroup freezer. This lets the daemon shed memory pressure from
+// long-running RUN steps without killing them outright.
+func (w containerdExecutor) Pause(ctx context.Context, id string) error {
+	task, err := w.getTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	return task.Pause(ctx)
+}
+
+// Resume resumes a container previously suspended with Pause.
+func (w containerdExecutor) Resume(ctx context.Context, id string) error {
+	task, err := w.getTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	return task.Resume(ctx)
+}
+
+// Checkpoint creates a CRIU-based checkpoint of the container's running task
+// and stores it as a containerd image under ref, so the container can later be
+// warm-started with Restore instead of being re-created from scratch.
+func (w containerdExecutor) Checkpoint(ctx context.Context, id, ref string) error {
+	task, err := w.getTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	// WithCheckpointTaskExit makes the task exit once checkpointed. Mark id
+	// so Run's cleanup recognizes that exit as part of a checkpoint and
+	// leaves the container/task around for Restore instead of deleting them.
+	w.mu.Lock()
+	w.checkpointed[id] = struct{}{}
+	w.mu.Unlock()
+	img, err := task.Checkpoint(ctx, containerd.WithCheckpointImage, containerd.WithCheckpointTaskExit)
+	if err != nil {
+		w.mu.Lock()
+		delete(w.checkpointed, id)
+		w.mu.Unlock()
+		return errors.Wrapf(err, "failed to checkpoint container %s", id)
+	}
+	imageRecord := images.Image{
+		Name:   ref,
+		Target: img.Target(),
+	}
+	if _, err := w.client.ImageService().Create(ctx, imageRecord); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "failed to tag checkpoint of container %s as %s", id, ref)
+		}
+		if _, err := w.client.ImageService().Update(ctx, imageRecord); err != nil {
+			return errors.Wrapf(err, "failed to retag checkpoint of container %s as %s", id, ref)
+		}
+	}
+	return nil
+}
+
+// Restore creates a new task for container id from a checkpoint previously
+// stored by Checkpoint under ref, warm-starting the container from the
+// checkpointed CRIU image instead of running its process from scratch.
+func (w containerdExecutor) Restore(ctx context.Context, id, ref string) error {
+	im, err := w.client.GetImage(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "checkpoint %s not found", ref)
+	}
+	container, err := w.client.LoadContainer(ctx, id)
+	if err != nil {
+		return errors.Wrapf(err, "container %s not found", id)
+	}
+	// The restored task has no caller-provided stdio to attach to, so give it
+	// /dev/null rather than wiring it to the daemon's own stdin/stdout/stderr.
+	task, err := container.NewTask(ctx, cio.NullIO, containerd.WithTaskCheckpoint(im))
+	if err != nil {
+		return errors.Wrapf(err, "failed to restore container %s from checkpoint %s", id, ref)
+	}
+	if err := task.Start(ctx); err != nil {
+		return errors.Wrapf(err, "failed to start restored container %s", id)
+	}
+	return nil
+}
+
 func (w containerdExecutor) Exec(ctx context.Context, id string, process executor.ProcessInfo) error {
 	meta := process.Meta
 
@@ -326,13 +514,43 @@ func (w containerdExecutor) Exec(ctx context.Context, id string, process executo
 		cioOpts = append(cioOpts, cio.WithTerminal)
 	}
 
-	taskProcess, err := task.Exec(ctx, identity.NewID(), proc, cio.NewCreator(cioOpts...))
+	execID := identity.NewID()
+	taskProcess, err := task.Exec(ctx, execID, proc, cio.NewCreator(cioOpts...))
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	return taskProcess.Start(ctx)
 }
 
+// Signal delivers sig to the container's main task, allowing callers (e.g. a
+// gateway client attached to an interactive debug session) to interrupt a
+// hung process without tearing down the whole container.
+func (w containerdExecutor) Signal(ctx context.Context, id string, sig syscall.Signal) error {
+	task, err := w.getTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	return task.Kill(ctx, sig)
+}
+
+// Resize changes the pty window size of a running process. When execID is
+// empty the container's main task is resized, otherwise the exec process
+// previously started with that id is resized.
+func (w containerdExecutor) Resize(ctx context.Context, id, execID string, width, height uint32) error {
+	task, err := w.getTask(ctx, id)
+	if err != nil {
+		return err
+	}
+	proc := containerd.Process(task)
+	if execID != "" {
+		proc, err = task.LoadProcess(ctx, execID, nil)
+		if err != nil {
+			return errors.Wrapf(err, "exec process %s not found in container %s", execID, id)
+		}
+	}
+	return proc.Resize(ctx, width, height)
+}
+
 func sendErr(c chan error, err error) error {
 	c <- err
 	return err
@@ -0,0 +1,88 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/moby/buildkit/cache"
+	"github.com/moby/buildkit/solver/pb"
+)
+
+// Executor is the interface for running a worker's processes.
+type Executor interface {
+	// Run will start a new container for the given id and run process in
+	// it. Further processes can be started in the running container with
+	// Exec.
+	Run(ctx context.Context, id string, rootfs cache.Mountable, mounts []Mount, process ProcessInfo, started chan<- struct{}) error
+	// Exec will start a process in container matching id. The process will
+	// share the namespaces of the container.
+	Exec(ctx context.Context, id string, process ProcessInfo) error
+
+	// Pause suspends the container's running task in place.
+	Pause(ctx context.Context, id string) error
+	// Resume resumes a container previously suspended with Pause.
+	Resume(ctx context.Context, id string) error
+	// Checkpoint creates a checkpoint of the container's running task and
+	// stores it under ref, so it can later be warm-started with Restore.
+	Checkpoint(ctx context.Context, id, ref string) error
+	// Restore starts a new task for id from a checkpoint previously stored
+	// under ref by Checkpoint.
+	Restore(ctx context.Context, id, ref string) error
+
+	// Signal delivers sig to the container's main process.
+	Signal(ctx context.Context, id string, sig syscall.Signal) error
+	// Resize changes the pty window size of a running process. When execID
+	// is empty the container's main process is resized, otherwise the exec
+	// process previously started under that id is resized.
+	Resize(ctx context.Context, id, execID string, width, height uint32) error
+}
+
+// Mount describes a mount for a process, mounted from Src into Dest of the
+// container's rootfs.
+type Mount struct {
+	Src      cache.Mountable
+	Selector string
+	Dest     string
+	Readonly bool
+}
+
+// DNS carries per-invocation DNS overrides that take precedence over the
+// executor's daemon-level DNS configuration for a single build.
+type DNS struct {
+	Nameservers   []string
+	SearchDomains []string
+	Options       []string
+}
+
+// Meta describes the metadata of a process to run in a container.
+type Meta struct {
+	Args           []string
+	Env            []string
+	Cwd            string
+	User           string
+	SecurityMode   pb.SecurityMode
+	NetMode        pb.NetMode
+	Hostname       string
+	ExtraHosts     []HostIP
+	Tty            bool
+	ReadonlyRootFS bool
+	// DNS, when set, overrides the executor's daemon-level DNS config
+	// (nameservers/search/options) for this invocation only.
+	DNS *DNS
+}
+
+// HostIP is a hostname/IP pair added to a container's /etc/hosts.
+type HostIP struct {
+	Host string
+	IP   net.IP
+}
+
+// ProcessInfo bundles a process's metadata together with the streams used to
+// attach its stdio.
+type ProcessInfo struct {
+	Meta           Meta
+	Stdin          io.ReadCloser
+	Stdout, Stderr io.WriteCloser
+}
@@ -10,17 +10,21 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
 	"github.com/moby/buildkit/session"
 	sessioncontent "github.com/moby/buildkit/session/content"
 	"github.com/moby/buildkit/source"
+	digest "github.com/opencontainers/go-digest"
 	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -67,18 +71,96 @@ func (r *OCILayoutResolver) Fetcher(ctx context.Context, ref string) (remotes.Fe
 	return r, nil
 }
 
-// Fetch get an io.ReadCloser for the specific content
+// Fetch get an io.ReadCloser for the specific content. Content already pulled
+// into the local store (r.store) is served straight from disk; anything else
+// is streamed from the session and written through to the local store so
+// later Fetches of the same descriptor don't pay for another round-trip.
 func (r *OCILayoutResolver) Fetch(ctx context.Context, desc ocispecs.Descriptor) (io.ReadCloser, error) {
+	if ra, err := r.store.ReaderAt(ctx, desc); err == nil {
+		return ioutil.NopCloser(&readerAtWrapper{readerAt: ra}), nil
+	}
+
 	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 	sessionID := r.sessionID
 
 	caller, err := r.sm.Get(timeoutCtx, sessionID, false)
 	if err != nil {
-		return r.fetchWithAnySession(ctx, desc)
+		rc, err := r.fetchWithAnySession(ctx, desc)
+		if err != nil {
+			return nil, err
+		}
+		return r.cacheAndServe(ctx, desc, rc)
+	}
+
+	rc, err := r.fetchWithSession(ctx, desc, caller)
+	if err != nil {
+		return nil, err
+	}
+	return r.cacheAndServe(ctx, desc, rc)
+}
+
+// cacheAndServe writes rc into the local content store keyed by desc's
+// digest and then reopens it from there, so the caller always reads from the
+// cache regardless of where the bytes originally came from.
+func (r *OCILayoutResolver) cacheAndServe(ctx context.Context, desc ocispecs.Descriptor, rc io.ReadCloser) (io.ReadCloser, error) {
+	defer rc.Close()
+	if err := content.WriteBlob(ctx, r.store, desc.Digest.String(), rc, desc); err != nil {
+		return nil, err
+	}
+	ra, err := r.store.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
 	}
+	return ioutil.NopCloser(&readerAtWrapper{readerAt: ra}), nil
+}
 
-	return r.fetchWithSession(ctx, desc, caller)
+// Prefetch walks a manifest's layer descriptors and warms the local content
+// store for all of them concurrently with a bounded worker pool, so a
+// subsequent build over the same OCI layout doesn't fetch its layers from the
+// session one at a time.
+func (r *OCILayoutResolver) Prefetch(ctx context.Context, manifest ocispecs.Descriptor) error {
+	rc, err := r.Fetch(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	var mfst ocispecs.Manifest
+	err = json.NewDecoder(rc).Decode(&mfst)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	// Dedupe by digest before fanning out: repeated layers (e.g. duplicate
+	// blank/empty layers) would otherwise race on the same content-store
+	// ingest lease and fail the whole prefetch over content that didn't even
+	// need refetching.
+	seen := make(map[digest.Digest]struct{}, len(mfst.Layers))
+	layers := make([]ocispecs.Descriptor, 0, len(mfst.Layers))
+	for _, layer := range mfst.Layers {
+		if _, ok := seen[layer.Digest]; ok {
+			continue
+		}
+		seen[layer.Digest] = struct{}{}
+		layers = append(layers, layer)
+	}
+
+	const maxConcurrency = 4
+	sem := make(chan struct{}, maxConcurrency)
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, layer := range layers {
+		layer := layer
+		eg.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			rc, err := r.Fetch(ctx, layer)
+			if err != nil {
+				return err
+			}
+			return rc.Close()
+		})
+	}
+	return eg.Wait()
 }
 
 func (r *OCILayoutResolver) fetchWithAnySession(ctx context.Context, desc ocispecs.Descriptor) (io.ReadCloser, error) {
@@ -137,17 +219,106 @@ func (r *OCILayoutResolver) Resolve(ctx context.Context, ref string) (string, oc
 	if err != nil {
 		return ref, ocispecs.Descriptor{}, err
 	}
+	if len(mfst.Manifests) == 0 {
+		return ref, ocispecs.Descriptor{}, errors.New(fmt.Sprintf("index missing: %s has no manifests", ociImageIndexFile))
+	}
 	refParsed, err := reference.Parse(ref)
 	if err != nil {
 		return ref, ocispecs.Descriptor{}, err
 	}
-	for _, el := range mfst.Manifests {
-		//FIXME add support for resolve by tag
-		if el.Digest == refParsed.Digest() {
-			return ref, el, nil
+	refDigest := refParsed.Digest()
+	refTag := refParsed.Object
+	if i := strings.IndexByte(refTag, '@'); i >= 0 {
+		refTag = refTag[:i]
+	}
+
+	var found *ocispecs.Descriptor
+	for i, el := range mfst.Manifests {
+		if refDigest != "" {
+			if el.Digest == refDigest {
+				found = &mfst.Manifests[i]
+				break
+			}
+			continue
+		}
+		if refTag == "" {
+			continue
+		}
+		// The ref-name annotation's value is either the bare tag or, for
+		// tools that mirror a git-style ref, "refs/tags/<tag>"; match either
+		// form against the tag requested in ref.
+		if name := el.Annotations[ocispecs.AnnotationRefName]; name == refTag || name == "refs/tags/"+refTag {
+			found = &mfst.Manifests[i]
+			break
+		}
+	}
+	if found == nil {
+		return ref, ocispecs.Descriptor{}, errors.New(fmt.Sprintf("tag not found: %s", ref))
+	}
+
+	desc := *found
+	if images.IsIndexType(desc.MediaType) {
+		desc, err = r.resolvePlatform(ctx, desc)
+		if err != nil {
+			return ref, ocispecs.Descriptor{}, err
+		}
+	}
+	return ref, desc, nil
+}
+
+// platformCtxKey is the context key WithPlatform stores the caller's
+// requested platform under.
+type platformCtxKey struct{}
+
+// WithPlatform returns a context carrying the caller's requested platform, so
+// a subsequent Resolve against a manifest list picks the matching child
+// manifest instead of defaulting to the daemon's own platform.
+func WithPlatform(ctx context.Context, platform ocispecs.Platform) context.Context {
+	return context.WithValue(ctx, platformCtxKey{}, platform)
+}
+
+// platformMatcherFromContext returns a Matcher for the platform set via
+// WithPlatform, falling back to the daemon's own platform when the caller
+// didn't request one.
+func platformMatcherFromContext(ctx context.Context) platforms.Matcher {
+	if p, ok := ctx.Value(platformCtxKey{}).(ocispecs.Platform); ok {
+		return platforms.Only(p)
+	}
+	return platforms.Default()
+}
+
+// resolvePlatform walks a (possibly nested) OCI image index, fetching each
+// child index with Fetch (local content store first, then the session), and
+// returns the descriptor
+// of the manifest matching the caller's requested platform (see
+// WithPlatform).
+func (r *OCILayoutResolver) resolvePlatform(ctx context.Context, desc ocispecs.Descriptor) (ocispecs.Descriptor, error) {
+	matcher := platformMatcherFromContext(ctx)
+	for images.IsIndexType(desc.MediaType) {
+		rc, err := r.Fetch(ctx, desc)
+		if err != nil {
+			return ocispecs.Descriptor{}, errors.New(fmt.Sprintf("failed to fetch index %s: %v", desc.Digest, err))
+		}
+		var idx ocispecs.Index
+		err = json.NewDecoder(rc).Decode(&idx)
+		rc.Close()
+		if err != nil {
+			return ocispecs.Descriptor{}, errors.New(fmt.Sprintf("failed to decode index %s: %v", desc.Digest, err))
+		}
+
+		var next *ocispecs.Descriptor
+		for i, m := range idx.Manifests {
+			if m.Platform != nil && matcher.Match(*m.Platform) {
+				next = &idx.Manifests[i]
+				break
+			}
+		}
+		if next == nil {
+			return ocispecs.Descriptor{}, errors.New(fmt.Sprintf("no matching platform for index %s", desc.Digest))
 		}
+		desc = *next
 	}
-	return ref, ocispecs.Descriptor{}, errors.New(fmt.Sprintf("not found %s", ref))
+	return desc, nil
 }
 
 func (r *OCILayoutResolver) Pusher(ctx context.Context, ref string) (remotes.Pusher, error) {